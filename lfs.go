@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+)
+
+// lfsAvailable reports whether the git-lfs binary is installed, so LFS: true
+// can be rejected up front with a clear error instead of failing deep
+// inside a fetch.
+func lfsAvailable() bool {
+	_, err := exec.LookPath("git-lfs")
+	return err == nil
+}
+
+// checkLFSConfig validates that git-lfs is installed whenever any watched
+// branch has LFS enabled.
+func checkLFSConfig(repos map[string]*Repo) error {
+	for repoName, repo := range repos {
+		for branchName, branch := range repo.Branches {
+			if branch.LFS && !lfsAvailable() {
+				return fmt.Errorf("%s/%s has lfs enabled but git-lfs is not installed", repoName, branchName)
+			}
+		}
+	}
+	return nil
+}
+
+// lfsFetch pulls LFS objects for refName into r's bare clone, reusing the
+// same GITHUB_USER/GITHUB_TOKEN credentials fetch() uses for github.com.
+func (r *Repo) lfsFetch(ctx context.Context, refName string) error {
+	args := append(r.lfsAuthArgs(), "lfs", "fetch", "origin", refName)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.storageDir()
+	return cmd.Run()
+}
+
+// lfsPush pushes every local LFS object to dest's URL, used after
+// mirroring a branch that has LFS enabled. It authenticates with dest's
+// own MirrorAuth — the same credentials pushToMirror uses for the git
+// push itself — rather than the source repo's creds, since dest is very
+// often not github.com, or uses different credentials than GITHUB_TOKEN.
+func (r *Repo) lfsPush(ctx context.Context, dest *MirrorDest) error {
+	args, env, err := dest.lfsAuthArgs()
+	if err != nil {
+		return err
+	}
+	args = append(args, "lfs", "push", dest.URL, "--all")
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.storageDir()
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd.Run()
+}
+
+// lfsAuthArgs returns "-c http.<url>.extraheader=..." git config overrides
+// so LFS's own HTTP requests to github.com carry GITHUB_USER/GITHUB_TOKEN,
+// the same way fetch() authenticates go-git's own transport.
+func (r *Repo) lfsAuthArgs() []string {
+	u, err := url.Parse(r.URL)
+	if err != nil || u.Host != "github.com" {
+		return nil
+	}
+	user := os.Getenv("GITHUB_USER")
+	token := os.Getenv("GITHUB_TOKEN")
+	if user == "" || token == "" {
+		return nil
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+	return []string{"-c", "http.https://github.com/.extraheader=Authorization: Basic " + basic}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	gitConfig "gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// mirrorPushRetryDelay is the initial delay between push retries. It is
+// doubled after every failed attempt, up to mirrorPushMaxRetryDelay.
+const mirrorPushRetryDelay = 2 * time.Second
+
+// mirrorPushMaxRetryDelay caps the exponential backoff applied to failed
+// mirror pushes.
+const mirrorPushMaxRetryDelay = 5 * time.Minute
+
+// MirrorAuth describes how to authenticate against a MirrorDest. At most
+// one of the two methods should be configured: env var based HTTP basic
+// auth, or an SSH private key.
+type MirrorAuth struct {
+	// EnvUser / EnvToken name environment variables holding HTTP basic
+	// auth credentials for the mirror's URL.
+	EnvUser  string `yaml:"env_user,omitempty"`
+	EnvToken string `yaml:"env_token,omitempty"`
+	// SSHKeyPath, if set, is used to authenticate over SSH instead.
+	SSHKeyPath string `yaml:"ssh_key_path,omitempty"`
+}
+
+// MirrorDest is a secondary remote a tracked branch should be mirrored to
+// after every observed ref update.
+type MirrorDest struct {
+	URL  string     `yaml:"url"`
+	Auth MirrorAuth `yaml:"auth,omitempty"`
+	// Branches restricts mirroring to the listed branch names. If empty,
+	// every branch tracked on the source Repo is mirrored.
+	Branches []string `yaml:"branches,omitempty"`
+	// LastPushedSHA is the hash last successfully pushed to this
+	// destination, so a restart (or a burst of updates that coalesces
+	// onto an already-pushed hash) doesn't redo work already done. It is
+	// not a force-with-lease: pushes are plain forced ref specs that will
+	// overwrite whatever this branch points to on dest, regardless of who
+	// put it there.
+	LastPushedSHA string `yaml:"last_pushed_sha,omitempty"`
+
+	mu      sync.Mutex
+	pending *mirrorJob
+	wake    chan struct{}
+
+	remoteOnce sync.Once
+	remoteErr  error
+}
+
+// remoteName is the stable git remote name used for d, shared by every
+// branch pushed to it so we don't accumulate one remote per (branch,
+// dest) pair. It's derived from a hash of the URL rather than the URL
+// itself, since remote names can't contain arbitrary characters.
+func (d *MirrorDest) remoteName() string {
+	sum := sha1.Sum([]byte(d.URL))
+	return "mirror-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// ensureRemote creates d's remote on r's bare clone exactly once.
+func (r *Repo) ensureRemote(dest *MirrorDest) error {
+	dest.remoteOnce.Do(func() {
+		_, err := r.gitRepo.CreateRemote(&gitConfig.RemoteConfig{
+			Name: dest.remoteName(),
+			URLs: []string{dest.URL},
+		})
+		if err != nil && err != git.ErrRemoteExists {
+			dest.remoteErr = err
+		}
+	})
+	return dest.remoteErr
+}
+
+// mirrorJob is one branch update queued for push to a MirrorDest.
+type mirrorJob struct {
+	branch string
+	hash   string
+}
+
+// tracksBranch reports whether branchName should be mirrored to d.
+func (d *MirrorDest) tracksBranch(branchName string) bool {
+	if len(d.Branches) == 0 {
+		return true
+	}
+	for _, b := range d.Branches {
+		if b == branchName {
+			return true
+		}
+	}
+	return false
+}
+
+// auth builds the go-git transport auth method for d, preferring the SSH
+// key if one is configured.
+func (d *MirrorDest) auth() (transport.AuthMethod, error) {
+	if d.Auth.SSHKeyPath != "" {
+		return ssh.NewPublicKeysFromFile("git", d.Auth.SSHKeyPath, "")
+	}
+	if d.Auth.EnvUser != "" && d.Auth.EnvToken != "" {
+		user := os.Getenv(d.Auth.EnvUser)
+		token := os.Getenv(d.Auth.EnvToken)
+		if user != "" && token != "" {
+			return &http.BasicAuth{Username: user, Password: token}, nil
+		}
+	}
+	return nil, nil
+}
+
+// lfsAuthArgs returns the "git -c ..." config overrides and/or extra
+// environment variables "git lfs push" needs to authenticate against d,
+// using d's own MirrorAuth rather than the source repo's credentials
+// (lfsPush otherwise has no way to reach a mirror that isn't github.com,
+// or that uses different creds than the source repo's GITHUB_TOKEN).
+func (d *MirrorDest) lfsAuthArgs() ([]string, []string, error) {
+	if d.Auth.SSHKeyPath != "" {
+		return nil, []string{"GIT_SSH_COMMAND=ssh -i " + d.Auth.SSHKeyPath + " -o IdentitiesOnly=yes"}, nil
+	}
+	if d.Auth.EnvUser != "" && d.Auth.EnvToken != "" {
+		user := os.Getenv(d.Auth.EnvUser)
+		token := os.Getenv(d.Auth.EnvToken)
+		if user != "" && token != "" {
+			u, err := url.Parse(d.URL)
+			if err != nil {
+				return nil, nil, err
+			}
+			basic := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+			header := "http." + u.Scheme + "://" + u.Host + "/.extraheader=Authorization: Basic " + basic
+			return []string{"-c", header}, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// startMirrors launches one worker goroutine per mirror destination. Each
+// worker drains its own pending job independently of the fetch loop, so a
+// slow or failing destination never blocks fetching or the others.
+// Workers exit once ctx is done.
+func (r *Repo) startMirrors(ctx context.Context) {
+	for _, dest := range r.Mirrors {
+		if dest.wake == nil {
+			dest.wake = make(chan struct{}, 1)
+		}
+		go r.runMirrorWorker(ctx, dest)
+	}
+}
+
+// runMirrorWorker waits for dest to have a pending job, then pushes it,
+// retrying with exponential backoff until it succeeds or ctx is
+// cancelled. Since enqueueMirrorPush always overwrites dest.pending with
+// the latest hash rather than queueing one entry per update, a worker
+// that falls behind a burst of fast-moving refs just pushes the newest
+// hash once it catches up, instead of replaying every intermediate one.
+func (r *Repo) runMirrorWorker(ctx context.Context, dest *MirrorDest) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dest.wake:
+		}
+
+		for {
+			dest.mu.Lock()
+			job := dest.pending
+			dest.pending = nil
+			dest.mu.Unlock()
+			if job == nil {
+				break
+			}
+
+			if job.hash == dest.LastPushedSHA {
+				continue
+			}
+
+			delay := mirrorPushRetryDelay
+			for {
+				err := r.pushToMirror(ctx, dest, *job)
+				if err == nil {
+					dest.LastPushedSHA = job.hash
+					break
+				}
+				debug("mirror push to", dest.URL, "failed:", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				delay *= 2
+				if delay > mirrorPushMaxRetryDelay {
+					delay = mirrorPushMaxRetryDelay
+				}
+			}
+		}
+	}
+}
+
+// pushToMirror force-pushes job.hash for job.branch to dest. go-git v4 has
+// no native --force-with-lease support, so this is a plain forced ref
+// spec: it always overwrites whatever dest.branch currently points to,
+// even if something else pushed there since we last looked. dest.LastPushedSHA
+// only dedupes re-pushing a hash we already pushed ourselves (so a
+// restart, or a burst that coalesces onto an already-pushed hash, doesn't
+// redo work); it is NOT a compare-and-swap lease and provides no
+// protection against clobbering commits a third party pushed to dest
+// directly. Operators who also write to a mirror destination by hand (or
+// from elsewhere) should expect this watcher to force-overwrite that work.
+// The whole push runs under r's storage lock, since it mutates the same
+// bare clone's config and object store fetch/diff/archive also touch.
+func (r *Repo) pushToMirror(ctx context.Context, dest *MirrorDest, job mirrorJob) error {
+	return withStorageLock(r.storageDir(), func() error {
+		if err := r.ensureRemote(dest); err != nil {
+			return err
+		}
+
+		// The source side must be the remote-tracking ref: r's bare clone
+		// never creates local heads (see types.go's initStorageDir),
+		// tracked branches only ever land under refs/remotes/origin/<branch>.
+		refSpec := gitConfig.RefSpec("+refs/remotes/origin/" + job.branch + ":refs/heads/" + job.branch)
+
+		auth, err := dest.auth()
+		if err != nil {
+			return err
+		}
+
+		err = r.gitRepo.PushContext(ctx, &git.PushOptions{
+			RemoteName: dest.remoteName(),
+			RefSpecs:   []gitConfig.RefSpec{refSpec},
+			Auth:       auth,
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return err
+		}
+
+		if branch, ok := r.Branches[job.branch]; ok && branch.LFS {
+			if err := r.lfsPush(ctx, dest); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// enqueueMirrorPush fans out a branch update to every MirrorDest tracking
+// that branch. Each dest keeps only its single latest pending job: if its
+// worker is still busy with a previous push, this overwrites dest.pending
+// with the new hash rather than queueing alongside it, so a destination
+// that falls behind a burst of updates coalesces onto the newest one
+// instead of working through every stale hash in between.
+func (r *Repo) enqueueMirrorPush(branchName, hash string) {
+	for _, dest := range r.Mirrors {
+		if !dest.tracksBranch(branchName) {
+			continue
+		}
+
+		dest.mu.Lock()
+		dest.pending = &mirrorJob{branch: branchName, hash: hash}
+		dest.mu.Unlock()
+
+		select {
+		case dest.wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	gitConfig "gopkg.in/src-d/go-git.v4/config"
+)
+
+// TestPushToMirrorRefSpec exercises pushToMirror end to end against real,
+// throwaway bare repos: an upstream pushed to by a working tree (standing
+// in for the watched GitHub repo), r's own bare clone (built the same way
+// initStorageDir would build one), and a mirror destination.
+// It asserts the branch lands under refs/heads/<branch> on the mirror,
+// which is what the "+refs/heads/<branch>:..." refspec bug broke: the
+// source side of the push must be refs/remotes/origin/<branch>, since r's
+// bare clone never creates local heads.
+func TestPushToMirrorRefSpec(t *testing.T) {
+	dir := t.TempDir()
+
+	upstream := filepath.Join(dir, "upstream.git")
+	runGit(t, dir, "init", "--bare", upstream)
+
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "clone", upstream, work)
+	runGit(t, work, "commit", "--allow-empty", "-m", "initial")
+	runGit(t, work, "push", "origin", "HEAD:refs/heads/main")
+
+	mirror := filepath.Join(dir, "mirror.git")
+	runGit(t, dir, "init", "--bare", mirror)
+
+	r := &Repo{
+		Name:     "test",
+		URL:      upstream,
+		Branches: map[string]*Branch{"main": {Name: "main"}},
+		dir:      filepath.Join(dir, "storage"),
+	}
+
+	gitRepo, err := git.PlainInit(r.dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.gitRepo = gitRepo
+	if _, err := gitRepo.CreateRemote(&gitConfig.RemoteConfig{Name: "origin", URLs: []string{r.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &MirrorDest{URL: mirror}
+	if err := r.pushToMirror(context.Background(), dest, mirrorJob{branch: "main", hash: ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := runGitOutput(t, mirror, "rev-parse", "refs/heads/main")
+	want := runGitOutput(t, work, "rev-parse", "HEAD")
+	if got != want {
+		t.Fatalf("mirror refs/heads/main = %q, want %q", got, want)
+	}
+}
+
+// TestMirrorDestTracksBranch covers the Branches allow-list: empty means
+// mirror everything, non-empty restricts to the listed names.
+func TestMirrorDestTracksBranch(t *testing.T) {
+	all := &MirrorDest{}
+	if !all.tracksBranch("main") {
+		t.Error("empty Branches should track every branch")
+	}
+
+	restricted := &MirrorDest{Branches: []string{"main", "release"}}
+	if !restricted.tracksBranch("release") {
+		t.Error("release should be tracked")
+	}
+	if restricted.tracksBranch("dev") {
+		t.Error("dev should not be tracked")
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func runGitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
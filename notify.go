@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+)
+
+// Event describes a ref update observed on a watched branch. Notifiers
+// receive the full set of diffs regardless of the branch's own Files
+// filter, so they can apply their own routing independently.
+type Event struct {
+	Repo   string
+	Branch string
+	URL    string
+	OldSHA string
+	NewSHA string
+	Diffs  []Diff
+}
+
+// Notifier is a sink that gets told about every Event routed to it.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// NotifierConfig configures one Notifier. It can be set at the top level
+// of a WatchConfig (applies to every repo) or on a specific Repo, so a
+// monorepo's infra/** changes can be routed to a dedicated Slack channel
+// while the default feed keeps receiving everything.
+type NotifierConfig struct {
+	Type string `yaml:"type"`
+
+	// URL is used by the webhook and chat notifier types.
+	URL string `yaml:"url,omitempty"`
+
+	// SMTPAddr, From and To configure the smtp notifier type.
+	SMTPAddr string   `yaml:"smtp_addr,omitempty"`
+	From     string   `yaml:"from,omitempty"`
+	To       []string `yaml:"to,omitempty"`
+
+	// Files, if set, restricts this notifier to events with at least one
+	// diff matching one of the listed patterns.
+	Files []string `yaml:"files,omitempty"`
+}
+
+// build constructs the Notifier described by c.
+func (c *NotifierConfig) build() (Notifier, error) {
+	switch c.Type {
+	case "", "feed":
+		return feedNotifier{}, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, errors.New("webhook notifier requires url")
+		}
+		return webhookNotifier{url: c.URL}, nil
+	case "chat":
+		if c.URL == "" {
+			return nil, errors.New("chat notifier requires url")
+		}
+		return chatNotifier{url: c.URL}, nil
+	case "smtp":
+		if c.SMTPAddr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, errors.New("smtp notifier requires smtp_addr, from and to")
+		}
+		return smtpNotifier{addr: c.SMTPAddr, from: c.From, to: c.To}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+	}
+}
+
+// matches reports whether event has at least one diff matching one of
+// c.Files, or always true if c.Files is empty.
+func (c *NotifierConfig) matches(event Event) bool {
+	if len(c.Files) == 0 {
+		return true
+	}
+	for _, pattern := range c.Files {
+		for _, diff := range event.Diffs {
+			if filePathMatchPattern(pattern, diff.File) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// boundNotifier pairs a built Notifier with the config it was built
+// from, so notify can apply the per-sink Files filter.
+type boundNotifier struct {
+	Notifier
+	config *NotifierConfig
+}
+
+// buildNotifiers resolves the top-level and per-repo NotifierConfigs
+// into the Notifiers that should receive r's events.
+func buildNotifiers(global []*NotifierConfig, repo []*NotifierConfig) ([]boundNotifier, error) {
+	var notifiers []boundNotifier
+	for _, c := range append(append([]*NotifierConfig{}, global...), repo...) {
+		n, err := c.build()
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, boundNotifier{Notifier: n, config: c})
+	}
+	return notifiers, nil
+}
+
+// notify fans event out to every notifier configured for r whose Files
+// filter (if any) matches one of the event's diffs.
+func (r *Repo) notify(ctx context.Context, event Event) {
+	for _, n := range r.notifiers {
+		if !n.config.matches(event) {
+			continue
+		}
+		if err := n.Notify(ctx, event); err != nil {
+			debug("notifier failed:", err)
+		}
+	}
+}
+
+// feedNotifier reproduces the watcher's original behavior: publishing an
+// RSS/Atom feed item.
+type feedNotifier struct{}
+
+func (feedNotifier) Notify(ctx context.Context, event Event) error {
+	title := event.Repo + " (" + event.OldSHA[:8] + " .. " + event.NewSHA[:8] + ")"
+	description := "Changes in " + event.Repo + " (<a href=\"" + event.URL + "\">" + event.URL + "</a>)<br><br>" +
+		"<b>" + event.OldSHA + "</b><br>"
+	for _, diff := range event.Diffs {
+		description += string(diff.Type) + " - " + diff.File + "<br>"
+	}
+	description += "<b>" + event.NewSHA + "</b>"
+	newFeedItem(title, description, event.URL)
+	return nil
+}
+
+// webhookPayload is the JSON body posted by webhookNotifier.
+type webhookPayload struct {
+	Repo    string        `json:"repo"`
+	Branch  string        `json:"branch"`
+	OldSHA  string        `json:"old_sha"`
+	NewSHA  string        `json:"new_sha"`
+	Changes []webhookDiff `json:"changes"`
+}
+
+type webhookDiff struct {
+	Type string `json:"type"`
+	File string `json:"file"`
+}
+
+// webhookNotifier POSTs a JSON description of the event to a generic
+// HTTP endpoint.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(ctx context.Context, event Event) error {
+	payload := webhookPayload{
+		Repo:   event.Repo,
+		Branch: event.Branch,
+		OldSHA: event.OldSHA,
+		NewSHA: event.NewSHA,
+	}
+	for _, diff := range event.Diffs {
+		payload.Changes = append(payload.Changes, webhookDiff{Type: string(diff.Type), File: diff.File})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// chatNotifier posts a Markdown-rendered summary to a Slack- or
+// Discord-style incoming webhook URL. Both platforms accept a plain JSON
+// body with the message text; we set both known field names since
+// they differ between the two ("text" for Slack, "content" for Discord).
+type chatNotifier struct {
+	url string
+}
+
+func (c chatNotifier) Notify(ctx context.Context, event Event) error {
+	message := fmt.Sprintf("*%s* (`%s`..`%s`)\n<%s>\n", event.Repo, event.OldSHA[:8], event.NewSHA[:8], event.URL)
+	for _, diff := range event.Diffs {
+		message += fmt.Sprintf("- `%s` %s\n", diff.Type, diff.File)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"text":    message,
+		"content": message,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("chat webhook %s returned %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails a plaintext summary of the event.
+type smtpNotifier struct {
+	addr string
+	from string
+	to   []string
+}
+
+func (s smtpNotifier) Notify(ctx context.Context, event Event) error {
+	subject := fmt.Sprintf("[%s] %s..%s", event.Repo, event.OldSHA[:8], event.NewSHA[:8])
+	body := fmt.Sprintf("Changes in %s (%s)\n\n%s..%s\n\n", event.Repo, event.URL, event.OldSHA, event.NewSHA)
+	for _, diff := range event.Diffs {
+		body += fmt.Sprintf("%s - %s\n", diff.Type, diff.File)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s", s.from, s.to[0], subject, body)
+	return smtp.SendMail(s.addr, nil, s.from, s.to, []byte(msg))
+}
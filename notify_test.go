@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestNotifierConfigMatches(t *testing.T) {
+	event := Event{
+		Diffs: []Diff{
+			{Type: "M", File: "infra/deploy.yaml"},
+			{Type: "A", File: "README.md"},
+		},
+	}
+
+	noFilter := &NotifierConfig{}
+	if !noFilter.matches(event) {
+		t.Error("a NotifierConfig with no Files filter should match every event")
+	}
+
+	matching := &NotifierConfig{Files: []string{"infra/*"}}
+	if !matching.matches(event) {
+		t.Error("infra/* should match infra/deploy.yaml")
+	}
+
+	nonMatching := &NotifierConfig{Files: []string{"docs/*"}}
+	if nonMatching.matches(event) {
+		t.Error("docs/* should not match infra/deploy.yaml or README.md")
+	}
+}
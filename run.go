@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultPollInterval is how often a repo is re-fetched when the caller
+// doesn't specify one.
+const defaultPollInterval = 1 * time.Minute
+
+// Run opens and watches every repo in cfg, one goroutine per repo, until
+// ctx is cancelled. It returns once every repo's watch loop has exited.
+func Run(ctx context.Context, cfg *WatchConfig, pollInterval time.Duration) error {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	if err := checkLFSConfig(cfg.Repos); err != nil {
+		return err
+	}
+
+	for name, repo := range cfg.Repos {
+		repo.Name = name
+		if err := repo.openOrInitGitRepo(ctx); err != nil {
+			return err
+		}
+
+		notifierConfigs := append(append([]*NotifierConfig{}, cfg.Notifiers...), repo.Notifiers...)
+		if len(notifierConfigs) == 0 {
+			// preserve the watcher's original behavior: publish to the feed
+			notifierConfigs = []*NotifierConfig{{Type: "feed"}}
+		}
+		notifiers, err := buildNotifiers(nil, notifierConfigs)
+		if err != nil {
+			return err
+		}
+		repo.notifiers = notifiers
+	}
+
+	if err := startArchiveServer(ctx, cfg.Repos); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, repo := range cfg.Repos {
+		wg.Add(1)
+		go func(r *Repo) {
+			defer wg.Done()
+			r.watch(ctx, pollInterval)
+		}(repo)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// watch calls fetchAndLookForChanges on a ticker until ctx is cancelled.
+func (r *Repo) watch(ctx context.Context, pollInterval time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.fetchAndLookForChanges(ctx); err != nil {
+				debug(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var httpAddr = flag.String("http", os.Getenv("HTTP_ADDR"), "address to serve tarball archives on, e.g. :8080 (defaults to $HTTP_ADDR)")
+
+// shaPattern matches the commit hashes writeArchive will accept. Anything
+// else is rejected before it reaches "git archive", which otherwise
+// parses a leading "-" as an option rather than a tree-ish.
+var shaPattern = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// archiveServer serves tar.gz archives of the commits each watched Repo
+// has last observed, so the watcher can double as a read-through cache
+// for downstream CI.
+type archiveServer struct {
+	repos map[string]*Repo
+}
+
+// startArchiveServer starts the HTTP archive server if --http/HTTP_ADDR
+// is set, shutting it down gracefully when ctx is done. It serves:
+//
+//	GET /<repo>/<branch>        archive of the branch's last recorded commit
+//	GET /<repo>/<branch>/<sha>  archive of a specific commit, if present locally
+func startArchiveServer(ctx context.Context, repos map[string]*Repo) error {
+	if *httpAddr == "" {
+		return nil
+	}
+	srv := &http.Server{Addr: *httpAddr, Handler: &archiveServer{repos: repos}}
+	go func() {
+		debug("archive server listening on", *httpAddr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			debug(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	return nil
+}
+
+func (s *archiveServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	repo, ok := s.repos[parts[0]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	branch, ok := repo.Branches[parts[1]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	sha := branch.Commit
+	if len(parts) == 3 && parts[2] != "" {
+		sha = parts[2]
+	}
+	if sha == "" || !shaPattern.MatchString(sha) {
+		http.NotFound(w, req)
+		return
+	}
+
+	if match := req.Header.Get("If-None-Match"); match != "" && match == sha {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if err := repo.writeArchive(req.Context(), w, sha, branch.Files); err != nil {
+		debug(err)
+		http.Error(w, "failed to generate archive", http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeArchive streams a tar.gz of sha (restricted to the pathspecs in
+// files, the branch's Files filter, if any) straight to w. Archive requests run under r's storage lock, so
+// they never race a concurrent fetch or mirror push against the same
+// bare clone.
+func (r *Repo) writeArchive(ctx context.Context, w http.ResponseWriter, sha string, files []string) error {
+	return withStorageLock(r.storageDir(), func() error {
+		args := append([]string{"archive", "--format=tar.gz", sha, "--"}, files...)
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = r.storageDir()
+		cmd.Stdout = w
+
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("ETag", sha)
+
+		return cmd.Run()
+	})
+}
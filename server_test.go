@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShaPattern(t *testing.T) {
+	valid := []string{"abc1234", "0123456789abcdef0123456789abcdef01234567"}
+	for _, sha := range valid {
+		if !shaPattern.MatchString(sha) {
+			t.Errorf("shaPattern should accept %q", sha)
+		}
+	}
+
+	invalid := []string{"", "-rf", "../../etc/passwd", "not-hex!", "abc"}
+	for _, sha := range invalid {
+		if shaPattern.MatchString(sha) {
+			t.Errorf("shaPattern should reject %q", sha)
+		}
+	}
+}
+
+// TestArchiveServerRejectsNonHexSHA guards against a sha that isn't
+// shaPattern-clean ever reaching "git archive", where a leading "-" would
+// otherwise be parsed as an option instead of a tree-ish.
+func TestArchiveServerRejectsNonHexSHA(t *testing.T) {
+	repo := &Repo{Name: "test", Branches: map[string]*Branch{"main": {Name: "main"}}}
+	srv := &archiveServer{repos: map[string]*Repo{"test": repo}}
+
+	req := httptest.NewRequest(http.MethodGet, "/test/main/--upload-pack=evil", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("non-hex sha in path: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
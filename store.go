@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// repoStore deduplicates concurrent first-time clones of the same URL,
+// modeled after the keyed singleflight cache cmd/go's module fetch code
+// uses to avoid two goroutines cloning the same repo at once. It only
+// covers the shared on-disk init step: every *Repo still opens its own
+// *git.Repository handle afterwards, so two Repo configs pointed at the
+// same URL (different branches/notifiers routed from one upstream) each
+// end up fully initialized, not just the first one to reach repoStore.
+var repoStore = newRepoStore()
+
+type repoStoreEntry struct {
+	once sync.Once
+	err  error
+}
+
+// RepoStore is a keyed singleflight: the first caller for a given URL runs
+// init, every concurrent or later caller waits for (or replays) its result.
+type RepoStore struct {
+	mu      sync.Mutex
+	entries map[string]*repoStoreEntry
+}
+
+func newRepoStore() *RepoStore {
+	return &RepoStore{entries: make(map[string]*repoStoreEntry)}
+}
+
+// once runs init exactly once for url, regardless of how many goroutines
+// (or how many *Repo configs sharing that url) call it concurrently. init
+// should only perform the one-time, URL-scoped setup (cloning/initializing
+// the shared bare repo on disk) — per-Repo state must be set up by the
+// caller after once returns, since it won't run again for a second Repo.
+func (s *RepoStore) once(url string, init func() error) error {
+	s.mu.Lock()
+	entry, ok := s.entries[url]
+	if !ok {
+		entry = &repoStoreEntry{}
+		s.entries[url] = entry
+	}
+	s.mu.Unlock()
+
+	entry.once.Do(func() {
+		entry.err = init()
+	})
+	return entry.err
+}
+
+// storageDirFor returns the content-addressed storage directory for url,
+// so two repos with the same Name but a different URL can never collide,
+// and a URL that no longer matches what's on disk becomes unreachable
+// (not something to detect and rmDir).
+func storageDirFor(rootDir, url string) string {
+	sum := sha1.Sum([]byte(url))
+	return rootDir + "/" + hex.EncodeToString(sum[:])
+}
+
+// lockFileName is the advisory lock file held for the duration of any
+// fetch/diff/archive/lfs operation against a repo's storage directory.
+const lockFileName = ".watcher.lock"
+
+// withStorageLock runs fn while holding an exclusive advisory lock on
+// dir's lock file, so concurrent watcher instances (or goroutines) never
+// fetch, diff, or archive the same bare clone at the same time.
+func withStorageLock(dir string, fn func() error) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dir+"/"+lockFileName, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return fn()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/url"
 	"os"
@@ -16,6 +17,8 @@ import (
 // WatchConfig is the configuration used to watch Github repositories
 type WatchConfig struct {
 	Repos map[string]*Repo `yaml:"repos"`
+	// Notifiers apply to every repo, in addition to each repo's own.
+	Notifiers []*NotifierConfig `yaml:"notifiers,omitempty"`
 }
 
 // Repo represents a watched Github repository
@@ -23,7 +26,17 @@ type Repo struct {
 	Name     string             `yaml:"-"`
 	URL      string             `yaml:"url"`
 	Branches map[string]*Branch `yaml:"branches"`
-	gitRepo  *git.Repository
+	// Mirrors lists secondary remotes tracked branches are pushed to
+	// whenever a ref update is observed.
+	Mirrors []*MirrorDest `yaml:"mirrors,omitempty"`
+	// Notifiers additionally routes this repo's events, on top of the
+	// WatchConfig's top-level notifiers.
+	Notifiers []*NotifierConfig `yaml:"notifiers,omitempty"`
+	gitRepo   *git.Repository
+	notifiers []boundNotifier
+	// dir is the content-addressed storage directory for URL, cached by
+	// storageDir.
+	dir string
 }
 
 // Branch contains what needs to be watched in the git branch
@@ -34,6 +47,11 @@ type Branch struct {
 	Commit string `yaml:"commit,omitempty"`
 	// if non empty, only listed files (or directories) will be watched
 	Files []string `yaml:"files,omitempty"`
+	// LFS, if true, fetches Git LFS objects for this branch after a fetch
+	// that moves the branch (or first sees it), so they're present locally
+	// for the archive server and for mirror pushes. Fetches that leave the
+	// branch where it was do not run an LFS fetch.
+	LFS bool `yaml:"lfs,omitempty"`
 }
 
 // GetBranchIfTracked returns *Branch corresponding to refName if listed in
@@ -49,115 +67,184 @@ func (r *Repo) GetBranchIfTracked(refName string) *Branch {
 	return nil
 }
 
+// storageDir returns the content-addressed storage directory for r.URL
+// (sha1(URL), under reposDir), so two Repos with the same Name but a
+// different URL can never collide.
 func (r *Repo) storageDir() string {
-	return reposDir + "/" + r.Name
+	if r.dir == "" {
+		r.dir = storageDirFor(reposDir, r.URL)
+	}
+	return r.dir
 }
 
-func (r *Repo) openOrInitGitRepo() error {
+// openOrInitGitRepo opens r's bare clone, initializing it on first use.
+// The on-disk init (clone/PlainInit + initial fetch) is shared through
+// repoStore and runs at most once per URL, but every Repo that calls this
+// — including a second Repo config pointed at a URL another Repo already
+// initialized — still gets its own *git.Repository handle opened and its
+// own mirrors started, since repoStore's singleflight only covers the
+// shared setup, not per-Repo state.
+func (r *Repo) openOrInitGitRepo(ctx context.Context) error {
+	dir := r.storageDir()
+
+	if err := repoStore.once(r.URL, func() error {
+		return withStorageLock(dir, func() error {
+			return initStorageDir(ctx, dir, r.URL)
+		})
+	}); err != nil {
+		return err
+	}
 
-	var err error
+	return withStorageLock(dir, func() error {
+		return r.openGitRepoAndSeedBranches(ctx)
+	})
+}
 
-	r.gitRepo, err = git.PlainOpen(r.storageDir())
+// initStorageDir makes sure dir holds a bare clone of repoURL with
+// "origin" configured and an initial fetch done. It runs at most once per
+// URL (see repoStore), so the actual cloning never happens twice even
+// when several Repo configs share a URL.
+func initStorageDir(ctx context.Context, dir, repoURL string) error {
+	gitRepo, err := git.PlainOpen(dir)
 
-	// repo found and opened, but is it the one we're looking for?
-	// we should check the URL and delete directory if it doesn't match
-	for err == nil {
+	// repo found and opened; make sure it isn't otherwise corrupt
+	if err == nil {
 		var remotes []*git.Remote
-		remotes, err = r.gitRepo.Remotes()
-
-		if err != nil {
-			rmDir(r.storageDir())
-			break
-		}
+		remotes, err = gitRepo.Remotes()
 
 		// TODO: allow several remotes
-		if len(remotes) > 1 {
+		if err == nil && len(remotes) > 1 {
 			err = errors.New("only one remote expected")
-			rmDir(r.storageDir())
-			break
 		}
 
-		if r.URL != remotes[0].Config().URL {
-			err = errors.New("remote URL is different from the one in the config")
-			debug(err)
-			rmDir(r.storageDir())
-			break
+		if err != nil {
+			rmDir(dir)
+		} else {
+			return nil
 		}
+	}
 
-		break
+	if err != git.ErrRepositoryNotExists {
+		return err
 	}
 
+	// repo does not exist yet: init & create remote (no need to clone)
+	gitRepo, err = git.PlainInit(dir, true)
 	if err != nil {
-		// if the repo does not exist, init & create remote (no need to clone)
-		if err == git.ErrRepositoryNotExists {
-			r.gitRepo, err = git.PlainInit(r.storageDir(), true)
-			if err != nil {
-				return err
-			}
-			// TODO: allow different remotes?
-			// repo.fetch fetches "origin" by default
-			// var remote *git.Remote
-			_, err = r.gitRepo.CreateRemote(&gitConfig.RemoteConfig{Name: "origin", URL: r.URL})
-
-			// initial fetch because we just added the remote
-			debug("initial fetch")
-			err = r.fetch()
-			if err != nil {
-				return err
+		return err
+	}
+	// TODO: allow different remotes?
+	// repo.fetch fetches "origin" by default
+	if _, err := gitRepo.CreateRemote(&gitConfig.RemoteConfig{Name: "origin", URLs: []string{repoURL}}); err != nil {
+		return err
+	}
+
+	// initial fetch because we just added the remote
+	debug("initial fetch")
+	return fetchGitRepo(ctx, gitRepo, repoURL)
+}
+
+// openGitRepoAndSeedBranches opens r's storage directory (already
+// initialized by initStorageDir by the time this runs) as r's own
+// *git.Repository handle, seeds any branch Commit left unset by the
+// config with what's currently on disk, and starts r's mirror workers.
+func (r *Repo) openGitRepoAndSeedBranches(ctx context.Context) error {
+	var err error
+	r.gitRepo, err = git.PlainOpen(r.storageDir())
+	if err != nil {
+		return err
+	}
+
+	// save current ref hash for any branch we're watching that doesn't
+	// already have one (the configuration file will be updated with
+	// these commits). Skip branches that already have a Commit, since
+	// the storage directory may have been initialized already by
+	// another Repo sharing this URL.
+	referencesIter, err := r.gitRepo.References()
+	if err != nil {
+		return err
+	}
+	referencesIter.ForEach(func(ref *gitPlumbing.Reference) error {
+		// only consider remotes
+		if ref.IsRemote() {
+			branch := r.GetBranchIfTracked(ref.Name().Short())
+			if branch != nil && branch.Commit == "" {
+				branch.Commit = ref.Hash().String()
 			}
 		}
-		if err != nil {
-			return err
-		}
+		return nil
+	})
 
-		// save current ref hash from each branch we're watching
-		// (the configuration file will be updated with these commits)
-		referencesIter, err := r.gitRepo.References()
-		if err != nil {
-			return err
-		}
-		referencesIter.ForEach(func(ref *gitPlumbing.Reference) error {
-			// only consider remotes
-			if ref.IsRemote() {
-				branch := r.GetBranchIfTracked(ref.Name().Short())
-				if branch != nil {
-					branch.Commit = ref.Hash().String()
-				}
-			}
-			return nil
-		})
-	}
+	r.startMirrors(ctx)
 
 	return nil
 }
 
-func (r *Repo) fetch() error {
+func (r *Repo) fetch(ctx context.Context) error {
+	return fetchGitRepo(ctx, r.gitRepo, r.URL)
+}
+
+// fetchGitRepo fetches "origin" on gitRepo, a bare clone of repoURL. It's
+// factored out of (*Repo).fetch so initStorageDir can run the very first
+// fetch before a Repo's own gitRepo handle exists yet.
+func fetchGitRepo(ctx context.Context, gitRepo *git.Repository, repoURL string) error {
 	// check url domain and env variables to see if Github token should be used
-	u, err := url.Parse(r.URL)
+	u, err := url.Parse(repoURL)
 	if err != nil {
 		debug(err)
 		return err
 	}
+
+	opts := &git.FetchOptions{}
 	if u.Host == "github.com" && os.Getenv("GITHUB_USER") != "" && os.Getenv("GITHUB_TOKEN") != "" {
-		err = r.gitRepo.Fetch(&git.FetchOptions{Auth: http.NewBasicAuth(os.Getenv("GITHUB_USER"), os.Getenv("GITHUB_TOKEN"))})
-	} else {
-		err = r.gitRepo.Fetch(&git.FetchOptions{})
+		opts.Auth = http.NewBasicAuth(os.Getenv("GITHUB_USER"), os.Getenv("GITHUB_TOKEN"))
+	}
+
+	err = gitRepo.FetchContext(ctx, opts)
+	if isNonFastForwardError(err) {
+		// the source branch was reset (force-pushed): a plain fetch
+		// refuses to move our local ref backwards, so redo it with
+		// Force so we follow the reset. fetchAndLookForChanges then
+		// sees the new hash like any other update and, via
+		// enqueueMirrorPush, mirrors the same reset downstream.
+		debug("non-fast-forward update on", repoURL, ", forcing fetch to follow the reset")
+		opts.Force = true
+		err = gitRepo.FetchContext(ctx, opts)
 	}
 	return err
 }
 
-func (r *Repo) fetchAndLookForChanges() error {
+// isNonFastForwardError reports whether err is go-git's non-fast-forward
+// update rejection, which a plain (non-Force) fetch returns when the
+// remote branch was reset behind where we last saw it.
+func isNonFastForwardError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "non-fast-forward update")
+}
 
+// fetchAndLookForChanges fetches r and reports any change on its tracked
+// branches. The fetch, LFS pull and diff all run under r's storage lock,
+// so they never race a concurrent fetch on the same bare clone.
+func (r *Repo) fetchAndLookForChanges(ctx context.Context) error {
 	if r.gitRepo == nil {
 		return errors.New("git repo not opened")
 	}
 
-	err := r.fetch()
+	var err error
+	lockErr := withStorageLock(r.storageDir(), func() error {
+		err = r.doFetchAndLookForChanges(ctx)
+		return nil
+	})
+	if lockErr != nil {
+		return lockErr
+	}
+	return err
+}
+
+func (r *Repo) doFetchAndLookForChanges(ctx context.Context) error {
+	err := r.fetch(ctx)
 
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		debug(err)
-		// TODO: an error here may be due to a force push
-		// we can just reset head and generate a message
 		return err
 	}
 
@@ -179,6 +266,14 @@ func (r *Repo) fetchAndLookForChanges() error {
 				if branch.Commit != ref.Hash().String() {
 					debug(branch.Commit, "!=", ref.Hash().String())
 
+					branchName := strings.TrimPrefix(ref.Name().Short(), "origin/")
+
+					if branch.LFS {
+						if err := r.lfsFetch(ctx, branchName); err != nil {
+							debug("lfs fetch for", r.Name, branchName, "failed:", err)
+						}
+					}
+
 					// this means we certainly fetch for the first time
 					// we don't have anything to compare, so let's just
 					// save the reference and return
@@ -187,12 +282,8 @@ func (r *Repo) fetchAndLookForChanges() error {
 						return nil
 					}
 
-					wd, err := os.Getwd()
-					if err != nil {
-						return err
-					}
-					os.Chdir(r.storageDir())
-					cmd := exec.Command("git", "diff", branch.Commit, ref.Hash().String(), "--name-status")
+					cmd := exec.CommandContext(ctx, "git", "diff", branch.Commit, ref.Hash().String(), "--name-status")
+					cmd.Dir = r.storageDir()
 					output, err := cmd.Output()
 					if err != nil {
 						return err
@@ -202,7 +293,6 @@ func (r *Repo) fetchAndLookForChanges() error {
 					for _, diff := range diffs {
 						debug(diff.Type, "-", diff.File)
 					}
-					os.Chdir(wd)
 
 					report := true
 
@@ -222,17 +312,18 @@ func (r *Repo) fetchAndLookForChanges() error {
 					}
 
 					if report {
-						title := r.Name + " (" + branch.Commit[:8] + " .. " + ref.Hash().String()[:8] + ")"
-						description := "Changes in " + r.Name + " (<a href=\"" + r.URL + "\">" + r.URL + "</a>)<br><br>" +
-							"<b>" + branch.Commit + "</b><br>"
-						for _, diff := range diffs {
-							description += string(diff.Type) + " - " + diff.File + "<br>"
-						}
-						description += "<b>" + ref.Hash().String() + "</b>"
-						newFeedItem(title, description, r.URL)
+						r.notify(ctx, Event{
+							Repo:   r.Name,
+							Branch: branchName,
+							URL:    r.URL,
+							OldSHA: branch.Commit,
+							NewSHA: ref.Hash().String(),
+							Diffs:  diffs,
+						})
 					}
 
 					branch.Commit = ref.Hash().String()
+					r.enqueueMirrorPush(branchName, branch.Commit)
 				}
 			}
 		}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsNonFastForwardError(t *testing.T) {
+	if isNonFastForwardError(nil) {
+		t.Error("nil error should not be reported as non-fast-forward")
+	}
+	if isNonFastForwardError(errors.New("some other failure")) {
+		t.Error("unrelated error should not be reported as non-fast-forward")
+	}
+	if !isNonFastForwardError(errors.New("non-fast-forward update: refs/heads/main")) {
+		t.Error("go-git's non-fast-forward update error should be detected")
+	}
+}
+
+// TestOpenOrInitGitRepoSharedURL covers two Repo configs pointed at the
+// same URL (e.g. one tracking "main" for notifications, another tracking
+// "release" for mirroring): the second Repo must still end up with its
+// own gitRepo handle and its own branch seeded, even though repoStore's
+// singleflight only runs the on-disk clone once.
+func TestOpenOrInitGitRepoSharedURL(t *testing.T) {
+	dir := t.TempDir()
+
+	upstream := filepath.Join(dir, "upstream.git")
+	runGit(t, dir, "init", "--bare", upstream)
+
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "clone", upstream, work)
+	runGit(t, work, "commit", "--allow-empty", "-m", "initial")
+	runGit(t, work, "push", "origin", "HEAD:refs/heads/main")
+
+	storageDir := filepath.Join(dir, "storage")
+
+	r1 := &Repo{Name: "r1", URL: upstream, Branches: map[string]*Branch{"main": {Name: "main"}}, dir: storageDir}
+	r2 := &Repo{Name: "r2", URL: upstream, Branches: map[string]*Branch{"main": {Name: "main"}}, dir: storageDir}
+
+	if err := r1.openOrInitGitRepo(context.Background()); err != nil {
+		t.Fatalf("r1.openOrInitGitRepo: %v", err)
+	}
+	if err := r2.openOrInitGitRepo(context.Background()); err != nil {
+		t.Fatalf("r2.openOrInitGitRepo: %v", err)
+	}
+
+	if r2.gitRepo == nil {
+		t.Fatal("r2.gitRepo is nil; shared-URL init skipped its per-Repo setup")
+	}
+	if r2.Branches["main"].Commit == "" {
+		t.Fatal("r2's branch was never seeded with its current commit")
+	}
+}